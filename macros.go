@@ -0,0 +1,40 @@
+package milter
+
+// Stage identifies a point in the milter protocol at which the MTA can be
+// asked to deliver specific macros (SMFIM_* in sendmail's libmilter). Values
+// match the real SMFIM_* wire numbers, since Server.RequestMacros sends them
+// as-is in the SMFIR_SETSYMLIST trailer of the OPTNEG reply.
+type Stage int
+
+const (
+	StageConnect  Stage = iota // SMFIM_CONNECT
+	StageHelo                  // SMFIM_HELO
+	StageMailFrom              // SMFIM_ENVFROM
+	StageRcptTo                // SMFIM_ENVRCPT
+	StageData                  // SMFIM_DATA
+	StageEOM                   // SMFIM_EOM
+	StageEOH                   // SMFIM_EOH
+)
+
+// stageForCmd maps an incoming command code to the Stage whose macros
+// precede it, per sendmail's SMFIC_MACRO convention.
+func stageForCmd(code byte) (Stage, bool) {
+	switch code {
+	case cmdConnect:
+		return StageConnect, true
+	case cmdHelo:
+		return StageHelo, true
+	case cmdMailFrom:
+		return StageMailFrom, true
+	case cmdRcptTo:
+		return StageRcptTo, true
+	case cmdData:
+		return StageData, true
+	case cmdEOH:
+		return StageEOH, true
+	case cmdBodyEOB:
+		return StageEOM, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,247 @@
+// Package milterclient implements the MTA side of the milter protocol, so
+// Milter implementations from the parent package can be exercised in unit
+// tests without a real MTA such as Postfix.
+package milterclient
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	milter "github.com/ryuichi1208/go-milter"
+)
+
+// Action is the verdict a Milter returns for a protocol stage.
+type Action = milter.Response
+
+// ModKind identifies the kind of change a Modification describes.
+type ModKind int
+
+const (
+	ModAddHeader ModKind = iota
+	ModChangeHeader
+	ModInsertHeader
+	ModAddRcpt
+	ModDelRcpt
+	ModReplaceBody
+	ModQuarantine
+	ModChangeFrom
+	ModAddRcptWithArgs
+)
+
+// Modification is one change a Milter requested while processing a
+// message, collected by EOB/SendEML in the order the Milter sent them.
+type Modification struct {
+	Kind  ModKind
+	Index int
+	Name  string
+	Value string
+	Body  []byte
+}
+
+// Client drives a Milter implementation over the wire protocol, acting as
+// the MTA. It is not safe for concurrent use.
+type Client struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	// Version, Actions and Protocol hold the negotiated values returned by
+	// the Milter in its SMFIC_OPTNEG reply.
+	Version  uint32
+	Actions  milter.OptAction
+	Protocol milter.OptProtocol
+}
+
+// NewClient wraps rw (typically a net.Conn to a Server) and performs the
+// initial option negotiation.
+func NewClient(rw io.ReadWriter) (*Client, error) {
+	c := &Client{
+		reader: bufio.NewReader(rw),
+		writer: bufio.NewWriter(rw),
+	}
+	if err := c.negotiate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) negotiate() error {
+	const requestedVersion = 6
+	const requestedActions = milter.OptAddHeader | milter.OptChangeHeader | milter.OptChangeBody |
+		milter.OptAddRcpt | milter.OptRemoveRcpt | milter.OptQuarantine |
+		milter.OptChangeFrom | milter.OptAddRcptWithArgs
+
+	body := append(wireUint32(requestedVersion), append(wireUint32(uint32(requestedActions)), wireUint32(0)...)...)
+	if err := writeFrame(c.writer, cmdOptNeg, body); err != nil {
+		return err
+	}
+
+	code, payload, err := readFrame(c.reader)
+	if err != nil {
+		return fmt.Errorf("milterclient: reading option negotiation reply: %w", err)
+	}
+	if code != cmdOptNeg || len(payload) < 12 {
+		return fmt.Errorf("milterclient: unexpected option negotiation reply %q", code)
+	}
+	c.Version = beUint32(payload[0:4])
+	c.Actions = milter.OptAction(beUint32(payload[4:8]))
+	c.Protocol = milter.OptProtocol(beUint32(payload[8:12]))
+	return nil
+}
+
+// Connect sends connection information to the Milter.
+func (c *Client) Connect(host string, family string, port uint16, addr string) (Action, error) {
+	payload := append([]byte(host), 0)
+	payload = append(payload, family[0])
+	if family == "T" || family == "6" {
+		payload = append(payload, byte(port>>8), byte(port))
+	}
+	payload = append(payload, addr...)
+	payload = append(payload, 0)
+	return c.roundTrip(cmdConnect, payload)
+}
+
+// Helo sends the HELO/EHLO name.
+func (c *Client) Helo(name string) (Action, error) {
+	return c.roundTrip(cmdHelo, wireStrings(name))
+}
+
+// MailFrom sends the envelope sender.
+func (c *Client) MailFrom(from string) (Action, error) {
+	return c.roundTrip(cmdMailFrom, wireStrings(from))
+}
+
+// RcptTo sends one envelope recipient.
+func (c *Client) RcptTo(rcpt string) (Action, error) {
+	return c.roundTrip(cmdRcptTo, wireStrings(rcpt))
+}
+
+// Header sends one message header.
+func (c *Client) Header(name, value string) (Action, error) {
+	return c.roundTrip(cmdHeader, wireStrings(name, value))
+}
+
+// EOH signals that all headers have been sent.
+func (c *Client) EOH() (Action, error) {
+	return c.roundTrip(cmdEOH, nil)
+}
+
+// BodyChunk sends one chunk (up to 64KB) of the message body.
+func (c *Client) BodyChunk(chunk []byte) (Action, error) {
+	return c.roundTrip(cmdBody, chunk)
+}
+
+// EOB signals the end of the message and collects every modification the
+// Milter requests before returning its final verdict.
+func (c *Client) EOB() (Action, []Modification, error) {
+	if err := writeFrame(c.writer, cmdBodyEOB, nil); err != nil {
+		return 0, nil, err
+	}
+
+	var mods []Modification
+	for {
+		code, payload, err := readFrame(c.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		if action, ok := actionForCode(code); ok {
+			return action, mods, nil
+		}
+		if code == 'p' {
+			// SMFIR_PROGRESS: keepalive, not a modification to collect.
+			continue
+		}
+		mod, err := parseModification(code, payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		mods = append(mods, mod)
+	}
+}
+
+// Abort tells the Milter the current message has been aborted.
+func (c *Client) Abort() error {
+	return writeFrame(c.writer, cmdAbort, nil)
+}
+
+// Quit closes out the session.
+func (c *Client) Quit() error {
+	return writeFrame(c.writer, cmdQuit, nil)
+}
+
+// roundTrip writes a command frame and reads back a single verdict.
+func (c *Client) roundTrip(code byte, payload []byte) (Action, error) {
+	if err := writeFrame(c.writer, code, payload); err != nil {
+		return 0, err
+	}
+	rcode, _, err := readFrame(c.reader)
+	if err != nil {
+		return 0, err
+	}
+	action, ok := actionForCode(rcode)
+	if !ok {
+		return 0, fmt.Errorf("milterclient: unexpected reply %q", rcode)
+	}
+	return action, nil
+}
+
+func actionForCode(code byte) (Action, bool) {
+	switch code {
+	case 'c':
+		return milter.RespContinue, true
+	case 'a':
+		return milter.RespAccept, true
+	case 'r':
+		return milter.RespReject, true
+	case 'd':
+		return milter.RespDiscard, true
+	case 't':
+		return milter.RespTempFail, true
+	case 's':
+		return milter.RespSkip, true
+	default:
+		return 0, false
+	}
+}
+
+func parseModification(code byte, payload []byte) (Modification, error) {
+	switch code {
+	case 'h':
+		parts := splitCStrings(payload)
+		return Modification{Kind: ModAddHeader, Name: at(parts, 0), Value: at(parts, 1)}, nil
+	case 'i':
+		idx := beUint32(payload)
+		parts := splitCStrings(payload[4:])
+		return Modification{Kind: ModInsertHeader, Index: int(idx), Name: at(parts, 0), Value: at(parts, 1)}, nil
+	case 'm':
+		idx := beUint32(payload)
+		parts := splitCStrings(payload[4:])
+		return Modification{Kind: ModChangeHeader, Index: int(idx), Name: at(parts, 0), Value: at(parts, 1)}, nil
+	case '+':
+		parts := splitCStrings(payload)
+		return Modification{Kind: ModAddRcpt, Value: at(parts, 0)}, nil
+	case '-':
+		parts := splitCStrings(payload)
+		return Modification{Kind: ModDelRcpt, Value: at(parts, 0)}, nil
+	case 'b':
+		return Modification{Kind: ModReplaceBody, Body: payload}, nil
+	case 'q':
+		parts := splitCStrings(payload)
+		return Modification{Kind: ModQuarantine, Value: at(parts, 0)}, nil
+	case 'e':
+		parts := splitCStrings(payload)
+		return Modification{Kind: ModChangeFrom, Value: at(parts, 0)}, nil
+	case '2':
+		parts := splitCStrings(payload)
+		return Modification{Kind: ModAddRcptWithArgs, Value: at(parts, 0), Name: at(parts, 1)}, nil
+	default:
+		return Modification{}, fmt.Errorf("milterclient: unknown action %q", code)
+	}
+}
+
+func at(ss []string, i int) string {
+	if i < len(ss) {
+		return ss[i]
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package milterclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	milter "github.com/ryuichi1208/go-milter"
+)
+
+type headerMilter struct {
+	milter.NoOpMilter
+}
+
+func (headerMilter) Body(ctx context.Context, m *milter.Modifier) (milter.Response, error) {
+	if err := m.AddHeader("X-Test", "ok"); err != nil {
+		return 0, err
+	}
+	return milter.RespAccept, nil
+}
+
+type rejectMilter struct {
+	milter.NoOpMilter
+}
+
+func (rejectMilter) MailFrom(ctx context.Context, from string, m *milter.Modifier) (milter.Response, error) {
+	if strings.Contains(from, "spam") {
+		return milter.RespReject, nil
+	}
+	return milter.RespContinue, nil
+}
+
+func TestTestServerNegotiation(t *testing.T) {
+	srv := &milter.Server{
+		NewMilter: func() milter.Milter { return &milter.NoOpMilter{} },
+		Actions:   milter.OptAddHeader | milter.OptQuarantine,
+	}
+	client, stop, err := TestServer(srv)
+	if err != nil {
+		t.Fatalf("TestServer: %v", err)
+	}
+	defer stop()
+
+	if client.Version == 0 {
+		t.Fatalf("expected a non-zero negotiated version, got %d", client.Version)
+	}
+	// Client.negotiate requests a broad set of actions; the server should
+	// only come back with the subset it actually wants.
+	if client.Actions != milter.OptAddHeader|milter.OptQuarantine {
+		t.Fatalf("expected negotiated actions to be intersected down to %#x, got %#x",
+			milter.OptAddHeader|milter.OptQuarantine, client.Actions)
+	}
+}
+
+func TestTestServerHeaderModification(t *testing.T) {
+	srv := &milter.Server{NewMilter: func() milter.Milter { return &headerMilter{} }}
+	client, stop, err := TestServer(srv)
+	if err != nil {
+		t.Fatalf("TestServer: %v", err)
+	}
+	defer stop()
+
+	action, mods, err := client.SendEML(strings.NewReader("Subject: hi\r\n\r\nbody\r\n"), "a@b.com", []string{"c@d.com"})
+	if err != nil {
+		t.Fatalf("SendEML: %v", err)
+	}
+	if action != milter.RespAccept {
+		t.Fatalf("expected RespAccept, got %v", action)
+	}
+	if len(mods) != 1 || mods[0].Kind != ModAddHeader || mods[0].Name != "X-Test" || mods[0].Value != "ok" {
+		t.Fatalf("expected a single X-Test header modification, got %+v", mods)
+	}
+}
+
+func TestTestServerReject(t *testing.T) {
+	srv := &milter.Server{NewMilter: func() milter.Milter { return &rejectMilter{} }}
+	client, stop, err := TestServer(srv)
+	if err != nil {
+		t.Fatalf("TestServer: %v", err)
+	}
+	defer stop()
+
+	action, mods, err := client.SendEML(strings.NewReader("Subject: hi\r\n\r\nbody\r\n"), "spammer@spam.com", []string{"c@d.com"})
+	if err != nil {
+		t.Fatalf("SendEML: %v", err)
+	}
+	if action != milter.RespReject {
+		t.Fatalf("expected RespReject, got %v", action)
+	}
+	if len(mods) != 0 {
+		t.Fatalf("expected no modifications on reject, got %+v", mods)
+	}
+}
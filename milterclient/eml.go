@@ -0,0 +1,70 @@
+package milterclient
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+
+	milter "github.com/ryuichi1208/go-milter"
+)
+
+// SendEML streams an RFC 5322 message in r through every protocol stage
+// (Connect, Helo, MailFrom, RcptTo, Header, EOH, BodyChunk, EOB) and
+// returns the Milter's final verdict plus every modification it requested.
+// It stops early and returns as soon as a stage returns anything other
+// than RespContinue.
+func (c *Client) SendEML(r io.Reader, from string, to []string) (Action, []Modification, error) {
+	tp := textproto.NewReader(bufio.NewReader(r))
+
+	if a, err := c.Connect("localhost", "T", 25, "127.0.0.1"); err != nil || a != milter.RespContinue {
+		return a, nil, err
+	}
+	if a, err := c.Helo("localhost"); err != nil || a != milter.RespContinue {
+		return a, nil, err
+	}
+	if a, err := c.MailFrom(from); err != nil || a != milter.RespContinue {
+		return a, nil, err
+	}
+	for _, rcpt := range to {
+		if a, err := c.RcptTo(rcpt); err != nil || a != milter.RespContinue {
+			return a, nil, err
+		}
+	}
+
+	for {
+		line, err := tp.ReadContinuedLine()
+		if err != nil || line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		a, err := c.Header(strings.TrimSpace(name), strings.TrimSpace(value))
+		if err != nil || a != milter.RespContinue {
+			return a, nil, err
+		}
+	}
+	if a, err := c.EOH(); err != nil || a != milter.RespContinue {
+		return a, nil, err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := tp.R.Read(buf)
+		if n > 0 {
+			if a, herr := c.BodyChunk(buf[:n]); herr != nil || a != milter.RespContinue {
+				return a, nil, herr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return c.EOB()
+}
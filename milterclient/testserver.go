@@ -0,0 +1,71 @@
+package milterclient
+
+import (
+	"errors"
+	"net"
+
+	milter "github.com/ryuichi1208/go-milter"
+)
+
+var errPipeClosed = errors.New("milterclient: test server closed")
+
+// TestServer wires srv to an in-memory Client over a net.Pipe, so a Milter
+// implementation can be driven end-to-end without a real MTA or listening
+// socket. Call the returned stop func to shut the pipe down once done;
+// it waits for srv.Serve to return.
+func TestServer(srv *milter.Server) (client *Client, stop func(), err error) {
+	serverConn, clientConn := net.Pipe()
+	ln := newPipeListener(serverConn)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	c, err := NewClient(clientConn)
+	if err != nil {
+		clientConn.Close()
+		ln.Close()
+		<-done
+		return nil, nil, err
+	}
+
+	stop = func() {
+		clientConn.Close()
+		ln.Close()
+		<-done
+	}
+	return c, stop, nil
+}
+
+// pipeListener adapts a single net.Conn (one side of a net.Pipe) into the
+// net.Listener that Server.Serve expects.
+type pipeListener struct {
+	conn   net.Conn
+	served bool
+	closed chan struct{}
+}
+
+func newPipeListener(conn net.Conn) *pipeListener {
+	return &pipeListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (p *pipeListener) Accept() (net.Conn, error) {
+	if !p.served {
+		p.served = true
+		return p.conn, nil
+	}
+	<-p.closed
+	return nil, errPipeClosed
+}
+
+func (p *pipeListener) Close() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	return nil
+}
+
+func (p *pipeListener) Addr() net.Addr {
+	return p.conn.LocalAddr()
+}
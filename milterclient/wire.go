@@ -0,0 +1,97 @@
+package milterclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Wire command/response codes, mirroring sendmail's libmilter SMFIC_*/
+// SMFIR_* constants. Kept local to this package rather than imported from
+// the milter package, since this client speaks the wire protocol
+// independently of the server implementation it is testing.
+const (
+	cmdOptNeg   = 'O'
+	cmdConnect  = 'C'
+	cmdHelo     = 'H'
+	cmdMailFrom = 'M'
+	cmdRcptTo   = 'R'
+	cmdHeader   = 'L'
+	cmdEOH      = 'N'
+	cmdBody     = 'B'
+	cmdBodyEOB  = 'E'
+	cmdAbort    = 'A'
+	cmdQuit     = 'Q'
+)
+
+// maxFrameSize bounds the length prefix read off the wire so a malformed
+// or hostile peer can't make us allocate an unbounded buffer.
+const maxFrameSize = 64*1024*1024 + 1024
+
+func readFrame(r *bufio.Reader) (code byte, payload []byte, err error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > maxFrameSize {
+		return 0, nil, fmt.Errorf("milterclient: invalid frame length %d", length)
+	}
+
+	code, err = r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, length-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return code, payload, nil
+}
+
+func writeFrame(w *bufio.Writer, code byte, payload []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(payload)+1)); err != nil {
+		return err
+	}
+	if err := w.WriteByte(code); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func wireUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func beUint32(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+func wireStrings(ss ...string) []byte {
+	var b []byte
+	for _, s := range ss {
+		b = append(b, s...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+func splitCStrings(payload []byte) []string {
+	var out []string
+	start := 0
+	for i, b := range payload {
+		if b == 0 {
+			out = append(out, string(payload[start:i]))
+			start = i + 1
+		}
+	}
+	if start < len(payload) {
+		out = append(out, string(payload[start:]))
+	}
+	return out
+}
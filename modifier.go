@@ -0,0 +1,105 @@
+package milter
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// Modifier is passed to every Milter callback. It identifies the current
+// session/message and lets the callback request changes to the message
+// being filtered; each method writes the corresponding SMFIR_* action frame
+// to the MTA immediately rather than buffering it locally.
+type Modifier struct {
+	sessionID string
+	mailID    string
+
+	macros map[Stage]map[string]string
+
+	writer *bufio.Writer
+}
+
+// SessionID returns the identifier of the current connection. It is stable
+// for the lifetime of the TCP/unix connection to the MTA.
+func (m *Modifier) SessionID() string {
+	return m.sessionID
+}
+
+// MailID returns the identifier of the message currently being processed.
+// It is assigned on every MAIL FROM and cleared again on Abort.
+func (m *Modifier) MailID() string {
+	return m.mailID
+}
+
+// Macros returns the macro values the MTA sent for the given Stage, as
+// requested via Server.RequestMacros. It returns nil if none were
+// requested or the MTA hasn't sent that stage yet.
+func (m *Modifier) Macros(stage Stage) map[string]string {
+	return m.macros[stage]
+}
+
+// AddHeader appends a new header to the message.
+func (m *Modifier) AddHeader(name, value string) error {
+	return m.writeAction('h', wireStrings(name, value))
+}
+
+// InsertHeader inserts a header at the given index (0-based, from the top
+// of the message).
+func (m *Modifier) InsertHeader(index int, name, value string) error {
+	return m.writeAction('i', append(wireUint32(uint32(index)), wireStrings(name, value)...))
+}
+
+// ChangeHeader replaces the value of the index'th occurrence of the named
+// header. A value of "" deletes it.
+func (m *Modifier) ChangeHeader(index int, name, value string) error {
+	return m.writeAction('m', append(wireUint32(uint32(index)), wireStrings(name, value)...))
+}
+
+// AddRecipient adds a recipient to the envelope.
+func (m *Modifier) AddRecipient(rcpt string) error {
+	return m.writeAction('+', wireStrings(rcpt))
+}
+
+// DeleteRecipient removes a recipient from the envelope.
+func (m *Modifier) DeleteRecipient(rcpt string) error {
+	return m.writeAction('-', wireStrings(rcpt))
+}
+
+// ReplaceBody replaces (a chunk of) the message body.
+func (m *Modifier) ReplaceBody(chunk []byte) error {
+	return m.writeAction('b', chunk)
+}
+
+// Progress tells the MTA the filter is still working, resetting its
+// read timeout for this session.
+func (m *Modifier) Progress() error {
+	return m.writeAction('p', nil)
+}
+
+// ChangeFrom replaces the envelope sender. Requires OptChangeFrom and
+// protocol version 6 or later.
+func (m *Modifier) ChangeFrom(from string) error {
+	return m.writeAction('e', wireStrings(from))
+}
+
+// AddRcptWithArgs adds a recipient together with its ESMTP arguments (the
+// part of the RCPT TO line after the address). Requires OptAddRcptWithArgs
+// and protocol version 6 or later.
+func (m *Modifier) AddRcptWithArgs(rcpt, esmtpArgs string) error {
+	return m.writeAction('2', wireStrings(rcpt, esmtpArgs))
+}
+
+// Quarantine places the message in the MTA's quarantine queue with the
+// given reason instead of delivering it. Requires OptQuarantine and
+// protocol version 6 or later.
+func (m *Modifier) Quarantine(reason string) error {
+	return m.writeAction('q', wireStrings(reason))
+}
+
+// writeAction writes a single SMFIR_* action frame: a 4-byte big-endian
+// length, the action code, and its payload.
+func (m *Modifier) writeAction(code byte, payload []byte) error {
+	if err := writeFrame(m.writer, code, payload); err != nil {
+		return fmt.Errorf("milter: write %c action: %w", code, err)
+	}
+	return m.writer.Flush()
+}
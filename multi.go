@@ -0,0 +1,216 @@
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/textproto"
+)
+
+// MultiMilter runs an ordered chain of child Milters for every callback so
+// operators can compose e.g. SPF + DKIM + spam-scoring filters in one
+// process instead of chaining separate milter daemons via Postfix's
+// smtpd_milters. Responses are merged using milter's own precedence
+// rules: RespReject/RespDiscard/RespTempFail from any child short-circuits
+// the stage and is returned immediately; RespAccept retires that child for
+// the rest of the current message (it runs again for the next message on
+// the same connection) but lets the others keep running; otherwise the
+// stage continues to the next child.
+//
+// Modifications (header/body/recipient changes) a child makes are
+// buffered and only replayed into the real Modifier once every child has
+// run for the current stage, so later children see the same message state
+// earlier children left it in.
+type MultiMilter struct {
+	children []Milter
+	accepted []bool
+}
+
+var _ Milter = (*MultiMilter)(nil)
+
+// NewMultiMilter returns a MultiMilter that runs children in order.
+func NewMultiMilter(children ...Milter) *MultiMilter {
+	return &MultiMilter{children: children, accepted: make([]bool, len(children))}
+}
+
+func (mm *MultiMilter) Connect(ctx context.Context, host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.Connect(ctx, host, family, port, addr, cm)
+	})
+}
+
+func (mm *MultiMilter) Helo(ctx context.Context, name string, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.Helo(ctx, name, cm)
+	})
+}
+
+func (mm *MultiMilter) MailFrom(ctx context.Context, from string, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.MailFrom(ctx, from, cm)
+	})
+}
+
+func (mm *MultiMilter) RcptTo(ctx context.Context, rcptTo string, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.RcptTo(ctx, rcptTo, cm)
+	})
+}
+
+func (mm *MultiMilter) Header(ctx context.Context, name string, value string, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.Header(ctx, name, value, cm)
+	})
+}
+
+func (mm *MultiMilter) Headers(ctx context.Context, h textproto.MIMEHeader, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.Headers(ctx, h, cm)
+	})
+}
+
+func (mm *MultiMilter) BodyChunk(ctx context.Context, chunk []byte, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.BodyChunk(ctx, chunk, cm)
+	})
+}
+
+func (mm *MultiMilter) Body(ctx context.Context, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.Body(ctx, cm)
+	})
+}
+
+func (mm *MultiMilter) Data(ctx context.Context, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.Data(ctx, cm)
+	})
+}
+
+func (mm *MultiMilter) Unknown(ctx context.Context, cmd string, m *Modifier) (Response, error) {
+	return mm.runStage(m, func(child Milter, cm *Modifier) (Response, error) {
+		return child.Unknown(ctx, cmd, cm)
+	})
+}
+
+func (mm *MultiMilter) Abort(ctx context.Context, m *Modifier) error {
+	for i, child := range mm.children {
+		if mm.accepted[i] {
+			continue
+		}
+		if err := child.Abort(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mm *MultiMilter) NewSession(ctx context.Context, sessionID string) error {
+	mm.resetAccepted()
+	for _, child := range mm.children {
+		if err := child.NewSession(ctx, sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetAccepted clears the per-child "retired" state. RespAccept only
+// retires a child for the rest of the current message, not the whole
+// connection, so this runs at the start of every message as well as every
+// new connection.
+func (mm *MultiMilter) resetAccepted() {
+	mm.accepted = make([]bool, len(mm.children))
+}
+
+func (mm *MultiMilter) Disconnect(ctx context.Context) error {
+	var firstErr error
+	for _, child := range mm.children {
+		if err := child.Disconnect(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (mm *MultiMilter) Init(ctx context.Context, sessionID string, mailID string) error {
+	mm.resetAccepted()
+	for _, child := range mm.children {
+		if err := child.Init(ctx, sessionID, mailID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStage calls fn for every child not already accepted, buffering the
+// Modifier actions it performs, and merges the results per milter
+// precedence. Buffered actions are replayed into m in child order once
+// the stage is done (or as soon as it short-circuits).
+func (mm *MultiMilter) runStage(m *Modifier, fn func(child Milter, cm *Modifier) (Response, error)) (Response, error) {
+	type pending struct {
+		buf *bytes.Buffer
+	}
+	var queued []pending
+	result := RespContinue
+
+	replay := func() error {
+		for _, p := range queued {
+			if p.buf.Len() == 0 {
+				continue
+			}
+			if _, err := m.writer.Write(p.buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return m.writer.Flush()
+	}
+
+	for i, child := range mm.children {
+		if mm.accepted[i] {
+			continue
+		}
+
+		buf := &bytes.Buffer{}
+		cm := &Modifier{sessionID: m.sessionID, mailID: m.mailID, macros: m.macros, writer: bufio.NewWriter(buf)}
+
+		r, err := fn(child, cm)
+		if err != nil {
+			return 0, err
+		}
+		queued = append(queued, pending{buf})
+
+		switch r {
+		case RespReject, RespDiscard, RespTempFail:
+			if err := replay(); err != nil {
+				return 0, err
+			}
+			return r, nil
+		case RespAccept:
+			mm.accepted[i] = true
+		case RespSkip:
+			if result == RespContinue {
+				result = RespSkip
+			}
+		}
+	}
+
+	if err := replay(); err != nil {
+		return 0, err
+	}
+
+	if len(mm.children) > 0 && allTrue(mm.accepted) {
+		return RespAccept, nil
+	}
+	return result, nil
+}
+
+func allTrue(bs []bool) bool {
+	for _, b := range bs {
+		if !b {
+			return false
+		}
+	}
+	return true
+}
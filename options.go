@@ -0,0 +1,60 @@
+package milter
+
+// OptAction is a bitmask of the modification actions a Milter intends to
+// perform during a session (SMFIF_* in sendmail's libmilter). The server
+// advertises it to the MTA during option negotiation so the MTA knows which
+// wire replies to expect.
+type OptAction uint32
+
+const (
+	OptAddHeader OptAction = 1 << iota
+	OptChangeBody
+	OptAddRcpt
+	OptRemoveRcpt
+	OptChangeHeader
+	OptQuarantine
+
+	// OptChangeFrom lets the Milter replace the envelope sender. Requires
+	// protocol version 6 or later.
+	OptChangeFrom
+
+	// OptAddRcptWithArgs lets the Milter add a recipient together with ESMTP
+	// arguments. Requires protocol version 6 or later.
+	OptAddRcptWithArgs
+
+	// OptSetSymList lets the Milter request specific macros per Stage via
+	// SMFIR_SETSYMLIST (see Server.RequestMacros). Requires protocol
+	// version 6 or later.
+	OptSetSymList
+)
+
+// OptProtocol is a bitmask of protocol flags (SMFIP_* in sendmail's
+// libmilter) that suppress individual callbacks or otherwise alter how the
+// MTA drives the session.
+type OptProtocol uint32
+
+// Bit values are explicit, not iota-derived: 0x80 is SMFIP_NR_HDR (the MTA
+// accepts no reply to SMFIC_HEADER), which this server doesn't use since it
+// always replies to headers, leaving a gap in the sequence.
+const (
+	OptNoConnect  OptProtocol = 0x01 // SMFIP_NOCONNECT
+	OptNoHelo     OptProtocol = 0x02 // SMFIP_NOHELO
+	OptNoMailFrom OptProtocol = 0x04 // SMFIP_NOMAIL
+	OptNoRcptTo   OptProtocol = 0x08 // SMFIP_NORCPT
+	OptNoBody     OptProtocol = 0x10 // SMFIP_NOBODY
+	OptNoHeaders  OptProtocol = 0x20 // SMFIP_NOHDRS
+	OptNoEOH      OptProtocol = 0x40 // SMFIP_NOEOH
+
+	// OptNoUnknown suppresses the Unknown callback. Requires protocol
+	// version 6 or later.
+	OptNoUnknown OptProtocol = 0x100 // SMFIP_NOUNKNOWN
+
+	// OptNoData suppresses the Data callback. Requires protocol version 6
+	// or later.
+	OptNoData OptProtocol = 0x200 // SMFIP_NODATA
+
+	// OptSkip lets the Milter reply SMFIR_SKIP from BodyChunk to stop
+	// receiving further body chunks without accepting or rejecting the
+	// message outright. Requires protocol version 6 or later.
+	OptSkip OptProtocol = 0x400 // SMFIP_SKIP
+)
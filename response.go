@@ -0,0 +1,30 @@
+package milter
+
+// Response represents the verdict a Milter callback returns for the current
+// protocol stage. The server translates it into the matching SMFIR_* wire
+// reply sent back to the MTA.
+type Response int
+
+const (
+	// RespContinue tells the MTA to proceed to the next stage normally.
+	RespContinue Response = iota
+
+	// RespAccept tells the MTA to accept the rest of the message/connection
+	// without further filtering.
+	RespAccept
+
+	// RespReject tells the MTA to permanently reject the current step.
+	RespReject
+
+	// RespDiscard tells the MTA to accept the message but silently drop it.
+	RespDiscard
+
+	// RespTempFail tells the MTA to reject the current step with a
+	// temporary failure, asking the sender to retry later.
+	RespTempFail
+
+	// RespSkip, valid only as a return value from BodyChunk, tells the MTA
+	// to stop sending further body chunks and proceed directly to Body.
+	// Requires OptSkip and protocol version 6 or later.
+	RespSkip
+)
@@ -5,13 +5,23 @@ import (
 	"errors"
 	"net"
 	"net/textproto"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Milter protocol version implemented by the server.
+// Highest milter protocol version supported by the server. The actual
+// version used for a given connection is negotiated down to whatever the
+// MTA proposes, down to a minimum of minServerProtocolVersion.
 //
 // Note: Not exported as we might want to support multiple versions
 // transparently in the future.
-var serverProtocolVersion uint32 = 2
+var serverProtocolVersion uint32 = 6
+
+// minServerProtocolVersion is the oldest protocol version the server still
+// speaks.
+const minServerProtocolVersion uint32 = 2
 
 // ErrServerClosed is returned by the Server's Serve method after a call to
 // Close.
@@ -55,6 +65,34 @@ type Milter interface {
 	// should be reset to prior to the Helo callback. Connection data should be
 	// preserved.
 	Abort(ctx context.Context, m *Modifier) error
+
+	// NewSession is called once a new connection from the MTA has been
+	// accepted, right after the Milter instance for it is created.
+	// sessionID uniquely identifies the connection for its whole lifetime
+	// and can be used to correlate log lines across callbacks.
+	NewSession(ctx context.Context, sessionID string) error
+
+	// Disconnect is called once the connection to the MTA has been closed,
+	// after the last callback for this session has returned. It is always
+	// called, even if the connection was dropped mid-message.
+	Disconnect(ctx context.Context) error
+
+	// Init is called at the start of every new message on the connection,
+	// before MailFrom, and again immediately on Abort so state can be
+	// reset as soon as a message is abandoned. mailID uniquely identifies
+	// the message and changes on every call; sessionID is the same value
+	// passed to NewSession.
+	Init(ctx context.Context, sessionID string, mailID string) error
+
+	// Data is called when the MTA issues the SMTP DATA command, after the
+	// last RcptTo and before the first Header. Requires protocol version 6
+	// or later; suppress with OptNoData.
+	Data(ctx context.Context, m *Modifier) (Response, error)
+
+	// Unknown is called for any SMTP command the MTA does not otherwise
+	// recognize. Requires protocol version 6 or later; suppress with
+	// OptNoUnknown.
+	Unknown(ctx context.Context, cmd string, m *Modifier) (Response, error)
 }
 
 // NoOpMilter is a dummy Milter implementation that does nothing.
@@ -98,48 +136,202 @@ func (NoOpMilter) Abort(ctx context.Context, m *Modifier) error {
 	return nil
 }
 
+func (NoOpMilter) NewSession(ctx context.Context, sessionID string) error {
+	return nil
+}
+
+func (NoOpMilter) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+func (NoOpMilter) Init(ctx context.Context, sessionID string, mailID string) error {
+	return nil
+}
+
+func (NoOpMilter) Data(ctx context.Context, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
+func (NoOpMilter) Unknown(ctx context.Context, cmd string, m *Modifier) (Response, error) {
+	return RespContinue, nil
+}
+
 // Server is a milter server.
 type Server struct {
 	NewMilter func() Milter
 	Actions   OptAction
 	Protocol  OptProtocol
 
+	// RequestMacros tells the MTA which macros to deliver at each protocol
+	// Stage (SMFIC_OPTNEG/SMFIR_SETSYMLIST), e.g.
+	// {StageConnect: {"{tls_version}", "{auth_authen}"}}. Received values
+	// are available to callbacks through Modifier.Macros.
+	RequestMacros map[Stage][]string
+
+	// ReadTimeout and WriteTimeout, if non-zero, bound how long the server
+	// waits on a single read/write of a connection before giving up on it.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxConcurrentConnections, if non-zero, caps how many sessions may be
+	// in flight at once; Serve blocks new Accepts once the limit is hit.
+	MaxConcurrentConnections int
+
+	idSeq uint64
+
+	initOnce sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	sem      chan struct{}
+
+	mu        sync.Mutex
 	listeners []net.Listener
+	conns     map[net.Conn]struct{}
 	closed    bool
+	wg        sync.WaitGroup
+}
+
+// init lazily sets up the bookkeeping Serve/Shutdown/Close rely on, so a
+// Server is still usable as a plain struct literal.
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.conns = make(map[net.Conn]struct{})
+		if s.MaxConcurrentConnections > 0 {
+			s.sem = make(chan struct{}, s.MaxConcurrentConnections)
+		}
+	})
 }
 
-// Serve starts the server.
+// nextID returns a monotonically increasing identifier, unique for the
+// lifetime of the Server, used to identify sessions and messages.
+func (s *Server) nextID() string {
+	return strconv.FormatUint(atomic.AddUint64(&s.idSeq, 1), 10)
+}
+
+// protocolVersion returns the milter protocol version this server
+// negotiates with the MTA.
+func (s *Server) protocolVersion() uint32 {
+	return serverProtocolVersion
+}
+
+// Serve accepts connections on ln, handling each with its own Milter
+// instance in a separate goroutine until Close or Shutdown is called.
 func (s *Server) Serve(ln net.Listener) error {
+	s.init()
 	defer ln.Close()
 
+	s.mu.Lock()
 	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			if s.closed {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
 				return ErrServerClosed
 			}
 			return err
 		}
 
+		if s.sem != nil {
+			select {
+			case s.sem <- struct{}{}:
+			case <-s.ctx.Done():
+				conn.Close()
+				return ErrServerClosed
+			}
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
 		session := milterSession{
-			server:   s,
-			actions:  s.Actions,
-			protocol: s.Protocol,
-			conn:     conn,
-			backend:  s.NewMilter(),
+			server:    s,
+			actions:   s.Actions,
+			protocol:  s.Protocol,
+			conn:      conn,
+			backend:   s.NewMilter(),
+			sessionID: s.nextID(),
 		}
-		go session.HandleMilterCommands()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.releaseConn(conn)
+			session.HandleMilterCommands(s.ctx)
+		}()
 	}
 }
 
+func (s *Server) releaseConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// Close immediately stops accepting new connections and force-closes every
+// in-flight connection, without waiting for their sessions to finish. Use
+// Shutdown for a graceful stop.
 func (s *Server) Close() error {
+	s.init()
+
+	s.mu.Lock()
 	s.closed = true
+	var err error
 	for _, ln := range s.listeners {
-		if err := ln.Close(); err != nil {
-			return err
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
 		}
 	}
-	return nil
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.cancel()
+	return err
+}
+
+// Shutdown stops accepting new connections and cancels the context passed
+// to every in-flight callback, then waits for all in-flight sessions to
+// finish on their own. If ctx is done first, any still-running connections
+// are force-closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.init()
+
+	s.mu.Lock()
+	s.closed = true
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,368 @@
+package milter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Command codes sent by the MTA, as defined by sendmail's libmilter
+// (SMFIC_*).
+const (
+	cmdOptNeg   = 'O'
+	cmdConnect  = 'C'
+	cmdHelo     = 'H'
+	cmdMailFrom = 'M'
+	cmdRcptTo   = 'R'
+	cmdHeader   = 'L'
+	cmdEOH      = 'N'
+	cmdBody     = 'B'
+	cmdBodyEOB  = 'E'
+	cmdAbort    = 'A'
+	cmdQuit     = 'Q'
+	cmdData     = 'T'
+	cmdUnknown  = 'U'
+	cmdMacro    = 'D'
+)
+
+// milterSession drives the milter wire protocol for a single connection
+// from the MTA, dispatching each command to the session's backend Milter.
+type milterSession struct {
+	server   *Server
+	actions  OptAction
+	protocol OptProtocol
+
+	conn    net.Conn
+	backend Milter
+
+	sessionID string
+	mailID    string
+
+	// version is the protocol version negotiated with the MTA, set once
+	// SMFIC_OPTNEG has been processed.
+	version uint32
+
+	// macros holds the macro values received via SMFIC_MACRO, keyed by the
+	// Stage they were sent for.
+	macros map[Stage]map[string]string
+
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// HandleMilterCommands reads and dispatches commands until the MTA closes
+// the connection, sends SMFIC_QUIT, or ctx is canceled (e.g. by
+// Server.Shutdown or Server.Close).
+func (s *milterSession) HandleMilterCommands(ctx context.Context) {
+	defer s.conn.Close()
+
+	s.reader = bufio.NewReader(s.conn)
+	s.writer = bufio.NewWriter(s.conn)
+
+	if err := s.backend.NewSession(ctx, s.sessionID); err != nil {
+		return
+	}
+	defer s.backend.Disconnect(ctx)
+
+	for {
+		s.applyReadDeadline()
+		code, payload, err := readFrame(s.reader)
+		if err != nil {
+			// Connection dropped or closed; nothing left to reply to.
+			return
+		}
+		s.applyWriteDeadline()
+
+		resp, err := s.dispatch(ctx, code, payload)
+		if err != nil {
+			return
+		}
+		if resp == nil {
+			continue
+		}
+		if err := s.writeResponse(*resp); err != nil {
+			return
+		}
+		if code == cmdQuit {
+			return
+		}
+	}
+}
+
+// applyReadDeadline sets the connection's read deadline from
+// Server.ReadTimeout, if configured.
+func (s *milterSession) applyReadDeadline() {
+	if s.server.ReadTimeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.server.ReadTimeout))
+	}
+}
+
+// applyWriteDeadline sets the connection's write deadline from
+// Server.WriteTimeout, if configured. It covers both the action frames a
+// callback writes via its Modifier and the final stage response.
+func (s *milterSession) applyWriteDeadline() {
+	if s.server.WriteTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.server.WriteTimeout))
+	}
+}
+
+func (s *milterSession) modifier() *Modifier {
+	return &Modifier{sessionID: s.sessionID, mailID: s.mailID, writer: s.writer, macros: s.macros}
+}
+
+// dispatch handles a single command frame, returning the Response to send
+// back to the MTA, or a nil Response when the command has no reply (e.g.
+// SMFIC_OPTNEG, which gets its own negotiation reply written in place).
+func (s *milterSession) dispatch(ctx context.Context, code byte, payload []byte) (*Response, error) {
+	switch code {
+	case cmdOptNeg:
+		return nil, s.negotiate(payload)
+
+	case cmdMacro:
+		return nil, s.recordMacros(payload)
+
+	case cmdConnect:
+		return s.handleConnect(ctx, payload)
+
+	case cmdHelo:
+		name := string(payload)
+		if i := indexByte(payload, 0); i >= 0 {
+			name = string(payload[:i])
+		}
+		r, err := s.backend.Helo(ctx, name, s.modifier())
+		return &r, err
+
+	case cmdMailFrom:
+		// MailFrom marks the start of a new message: on the first message
+		// of the connection this is the Init call that would otherwise
+		// precede Connect; on later messages it's the only signal that a
+		// new message has begun, since the MTA need not send Abort first.
+		if err := s.startMessage(ctx); err != nil {
+			return nil, err
+		}
+		args := splitCStrings(payload)
+		from := ""
+		if len(args) > 0 {
+			from = args[0]
+		}
+		r, err := s.backend.MailFrom(ctx, from, s.modifier())
+		return &r, err
+
+	case cmdRcptTo:
+		args := splitCStrings(payload)
+		rcpt := ""
+		if len(args) > 0 {
+			rcpt = args[0]
+		}
+		r, err := s.backend.RcptTo(ctx, rcpt, s.modifier())
+		return &r, err
+
+	case cmdHeader:
+		parts := splitCStrings(payload)
+		name, value := "", ""
+		if len(parts) > 0 {
+			name = parts[0]
+		}
+		if len(parts) > 1 {
+			value = parts[1]
+		}
+		r, err := s.backend.Header(ctx, name, value, s.modifier())
+		return &r, err
+
+	case cmdEOH:
+		r, err := s.backend.Headers(ctx, textproto.MIMEHeader{}, s.modifier())
+		return &r, err
+
+	case cmdBody:
+		r, err := s.backend.BodyChunk(ctx, payload, s.modifier())
+		return &r, err
+
+	case cmdBodyEOB:
+		r, err := s.backend.Body(ctx, s.modifier())
+		return &r, err
+
+	case cmdData:
+		r, err := s.backend.Data(ctx, s.modifier())
+		return &r, err
+
+	case cmdUnknown:
+		cmd := string(bytesTrimNull(payload))
+		r, err := s.backend.Unknown(ctx, cmd, s.modifier())
+		return &r, err
+
+	case cmdAbort:
+		err := s.backend.Abort(ctx, s.modifier())
+		if err != nil {
+			return nil, err
+		}
+		if err := s.startMessage(ctx); err != nil {
+			return nil, err
+		}
+		return nil, nil
+
+	case cmdQuit:
+		r := RespAccept
+		return &r, nil
+
+	default:
+		return nil, fmt.Errorf("milter: unsupported command %q", code)
+	}
+}
+
+// startMessage assigns a new mail ID and runs the Init hook, marking the
+// beginning of a new message on this connection.
+func (s *milterSession) startMessage(ctx context.Context) error {
+	s.mailID = s.server.nextID()
+	return s.backend.Init(ctx, s.sessionID, s.mailID)
+}
+
+// recordMacros handles SMFIC_MACRO: a command code identifying which Stage
+// the macros precede, followed by NUL-separated name/value pairs.
+func (s *milterSession) recordMacros(payload []byte) error {
+	if len(payload) < 1 {
+		return errors.New("milter: malformed macro command")
+	}
+	stage, ok := stageForCmd(payload[0])
+	if !ok {
+		return nil
+	}
+
+	pairs := splitCStrings(payload[1:])
+	values := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		values[pairs[i]] = pairs[i+1]
+	}
+
+	if s.macros == nil {
+		s.macros = make(map[Stage]map[string]string)
+	}
+	s.macros[stage] = values
+	return nil
+}
+
+func (s *milterSession) handleConnect(ctx context.Context, payload []byte) (*Response, error) {
+	// Payload: hostname cstring, family byte, port uint16 (T/6 only), address cstring.
+	nameEnd := indexByte(payload, 0)
+	if nameEnd < 0 {
+		return nil, errors.New("milter: malformed connect command")
+	}
+	host := string(payload[:nameEnd])
+	rest := payload[nameEnd+1:]
+	if len(rest) < 1 {
+		return nil, errors.New("milter: malformed connect command")
+	}
+	family := string(rest[:1])
+	rest = rest[1:]
+
+	var port uint16
+	if family == "T" || family == "6" {
+		if len(rest) < 2 {
+			return nil, errors.New("milter: malformed connect command")
+		}
+		port = uint16(rest[0])<<8 | uint16(rest[1])
+		rest = rest[2:]
+	}
+	addr := net.ParseIP(string(bytesTrimNull(rest)))
+
+	r, err := s.backend.Connect(ctx, host, family, port, addr, s.modifier())
+	return &r, err
+}
+
+// negotiate parses the MTA's SMFIC_OPTNEG proposal, agrees on the highest
+// protocol version both sides support, and replies with that version plus
+// the actions/protocol flags this server requires.
+func (s *milterSession) negotiate(payload []byte) error {
+	if len(payload) < 12 {
+		return errors.New("milter: malformed option negotiation command")
+	}
+	peerVersion := beUint32(payload[0:4])
+	peerActions := OptAction(beUint32(payload[4:8]))
+	peerProtocol := OptProtocol(beUint32(payload[8:12]))
+
+	s.version = s.server.protocolVersion()
+	if peerVersion < s.version {
+		s.version = peerVersion
+	}
+	if s.version < minServerProtocolVersion {
+		return fmt.Errorf("milter: MTA proposed unsupported protocol version %d", peerVersion)
+	}
+
+	// Only request actions and protocol flags the MTA actually declared it
+	// supports; peerProtocol is the MTA's capability advertisement, not a
+	// suppression request, so intersect rather than union it.
+	s.actions &= peerActions
+	s.protocol &= peerProtocol
+
+	if len(s.server.RequestMacros) > 0 && peerActions&OptSetSymList != 0 {
+		s.actions |= OptSetSymList
+	}
+
+	body := append(wireUint32(s.version), append(wireUint32(uint32(s.actions)), wireUint32(uint32(s.protocol))...)...)
+
+	// Macro requests (SMFIR_SETSYMLIST) are appended to the OPTNEG reply
+	// itself, one stage/macro-list pair at a time, rather than sent as
+	// their own frames: this is the only reply the MTA expects at this
+	// point in the handshake, so a separate frame here would desync the
+	// connection.
+	if s.actions&OptSetSymList != 0 {
+		for stage := StageConnect; stage <= StageEOH; stage++ {
+			names, ok := s.server.RequestMacros[stage]
+			if !ok || len(names) == 0 {
+				continue
+			}
+			body = append(body, wireUint32(uint32(stage))...)
+			body = append(body, strings.Join(names, " ")...)
+			body = append(body, 0)
+		}
+	}
+
+	if err := writeFrame(s.writer, cmdOptNeg, body); err != nil {
+		return err
+	}
+
+	return s.writer.Flush()
+}
+
+// writeResponse translates a Response into its SMFIR_* wire reply.
+func (s *milterSession) writeResponse(r Response) error {
+	var code byte
+	switch r {
+	case RespAccept:
+		code = 'a'
+	case RespReject:
+		code = 'r'
+	case RespDiscard:
+		code = 'd'
+	case RespTempFail:
+		code = 't'
+	case RespSkip:
+		code = 's'
+	default:
+		code = 'c'
+	}
+	if err := writeFrame(s.writer, code, nil); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+func indexByte(b []byte, c byte) int {
+	for i, v := range b {
+		if v == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func bytesTrimNull(b []byte) []byte {
+	if i := indexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
@@ -0,0 +1,102 @@
+package milter
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+)
+
+// pipeListener adapts a single net.Conn (one side of a net.Pipe) into the
+// net.Listener that Server.Serve expects, mirroring
+// milterclient.pipeListener for tests internal to this package.
+type pipeListener struct {
+	conn   net.Conn
+	served bool
+	closed chan struct{}
+}
+
+var errPipeListenerClosed = errors.New("milter: test listener closed")
+
+func newPipeListener(conn net.Conn) *pipeListener {
+	return &pipeListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (p *pipeListener) Accept() (net.Conn, error) {
+	if !p.served {
+		p.served = true
+		return p.conn, nil
+	}
+	<-p.closed
+	return nil, errPipeListenerClosed
+}
+
+func (p *pipeListener) Close() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	return nil
+}
+
+func (p *pipeListener) Addr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+// TestNegotiateSetSymList exercises the SMFIR_SETSYMLIST trailer appended
+// to the OPTNEG reply when the peer advertises OptSetSymList and the
+// server has RequestMacros configured: it asserts the exact reply bytes,
+// in particular that each stage is wire-encoded as a 4-byte big-endian
+// SMFIM_* value rather than a single byte.
+func TestNegotiateSetSymList(t *testing.T) {
+	srv := &Server{
+		NewMilter:     func() Milter { return &NoOpMilter{} },
+		RequestMacros: map[Stage][]string{StageHelo: {"{tls_version}", "j"}},
+	}
+
+	serverConn, clientConn := net.Pipe()
+	ln := newPipeListener(serverConn)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	defer func() {
+		clientConn.Close()
+		ln.Close()
+		<-done
+	}()
+
+	reader := bufio.NewReader(clientConn)
+	writer := bufio.NewWriter(clientConn)
+
+	peerActions := uint32(OptAddHeader | OptSetSymList)
+	body := append(wireUint32(6), append(wireUint32(peerActions), wireUint32(0)...)...)
+	if err := writeFrame(writer, cmdOptNeg, body); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	code, payload, err := readFrame(reader)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if code != cmdOptNeg {
+		t.Fatalf("expected OPTNEG reply, got %q", code)
+	}
+	if len(payload) < 12 {
+		t.Fatalf("reply payload too short: %d bytes", len(payload))
+	}
+
+	gotActions := OptAction(beUint32(payload[4:8]))
+	if gotActions&OptSetSymList == 0 {
+		t.Fatalf("expected OptSetSymList in negotiated actions, got %#x", gotActions)
+	}
+
+	want := append(wireUint32(uint32(StageHelo)), []byte("{tls_version} j")...)
+	want = append(want, 0)
+	got := payload[12:]
+	if string(got) != string(want) {
+		t.Fatalf("unexpected SETSYMLIST trailer\n got: %q\nwant: %q", got, want)
+	}
+}
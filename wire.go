@@ -0,0 +1,88 @@
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxFrameSize bounds the length prefix read off the wire so a malformed or
+// hostile peer can't make us allocate an unbounded buffer.
+const maxFrameSize = 64*1024*1024 + 1024
+
+// readFrame reads one length-prefixed milter command frame: a 4-byte
+// big-endian length followed by a 1-byte command code and its payload.
+func readFrame(r *bufio.Reader) (code byte, payload []byte, err error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > maxFrameSize {
+		return 0, nil, fmt.Errorf("milter: invalid frame length %d", length)
+	}
+
+	code, err = r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	payload = make([]byte, length-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return code, payload, nil
+}
+
+// writeFrame writes one length-prefixed milter response/action frame.
+func writeFrame(w *bufio.Writer, code byte, payload []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(payload)+1)); err != nil {
+		return err
+	}
+	if err := w.WriteByte(code); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// wireUint32 encodes v as a 4-byte big-endian value.
+func wireUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// beUint32 decodes the first 4 bytes of b as a big-endian value.
+func beUint32(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+// wireStrings NUL-terminates and concatenates each string, the format used
+// for string arguments in milter command/action payloads.
+func wireStrings(ss ...string) []byte {
+	var b []byte
+	for _, s := range ss {
+		b = append(b, s...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+// splitCStrings splits a NUL-terminated/NUL-separated payload into its
+// component strings, dropping a trailing empty element left by the final
+// terminator.
+func splitCStrings(payload []byte) []string {
+	var out []string
+	start := 0
+	for i, b := range payload {
+		if b == 0 {
+			out = append(out, string(payload[start:i]))
+			start = i + 1
+		}
+	}
+	if start < len(payload) {
+		out = append(out, string(payload[start:]))
+	}
+	return out
+}